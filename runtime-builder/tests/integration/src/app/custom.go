@@ -0,0 +1,403 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging/logadmin"
+	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/api/iterator"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	clouderrorreportingpb "google.golang.org/genproto/googleapis/devtools/clouderrorreporting/v1beta1"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+const (
+	defaultProbeTimeoutMS = 5000
+	probePollInterval     = 250 * time.Millisecond
+	probeLatencyMetric    = "custom.googleapis.com/postpush/probe_latency_ms"
+
+	// exceptionProbeTimeoutMS is longer than defaultProbeTimeoutMS because
+	// Error Reporting's group/event aggregation lags well behind the
+	// underlying write, unlike the direct reads the logging/monitoring
+	// round-trips use.
+	exceptionProbeTimeoutMS = 60000
+)
+
+// probe describes one post-push self-test. Path is requested against this
+// process itself (http://localhost:8080<Path>). Verify, if set, selects a
+// built-in check that round-trips a random token through Stackdriver
+// instead of just checking the HTTP response.
+type probe struct {
+	Name    string `json:"name,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Timeout int    `json:"timeout,omitempty"` // milliseconds; defaults to defaultProbeTimeoutMS
+	Verify  string `json:"verify,omitempty"`  // "", "logging", "monitoring", or "exception"
+}
+
+// probeResult is the outcome of running one probe.
+type probeResult struct {
+	Name      string `json:"name"`
+	Path      string `json:"path,omitempty"`
+	Status    int    `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	BodyHash  string `json:"body_hash,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// defaultProbes is the built-in post-push verification matrix, run whenever
+// the caller doesn't supply its own via POST body; probes from
+// CUSTOM_PROBES_FILE are run in addition to it.
+var defaultProbes = []probe{
+	{Name: "Version", Path: "/version"},
+	{Name: "Lookup Host", Path: "/lookup_host"},
+	{Name: "TimeZone", Path: "/tzinfo"},
+	{Name: "Logging round-trip", Path: "/logging_custom", Verify: "logging"},
+	{Name: "Monitoring round-trip", Path: "/monitoring", Verify: "monitoring"},
+	{Name: "Exception Reporting", Path: "/exception", Verify: "exception", Timeout: exceptionProbeTimeoutMS},
+}
+
+// customHandler runs the post-push self-test matrix and reports the result
+// of each probe as JSON, returning a non-2xx status if any probe failed so a
+// CI runner can gate a deploy on it. The matrix is either the built-in
+// defaultProbes, a POST body of probes, or (for any other method) probes
+// loaded from the file named by CUSTOM_PROBES_FILE, appended to the defaults.
+func customHandler(w http.ResponseWriter, r *http.Request) error {
+	probes := defaultProbes
+	switch {
+	case r.Method == http.MethodPost:
+		var custom []probe
+		if err := json.NewDecoder(r.Body).Decode(&custom); err != nil {
+			return fmt.Errorf("decode probes: %v", err)
+		}
+		r.Body.Close()
+		probes = custom
+	case os.Getenv("CUSTOM_PROBES_FILE") != "":
+		extra, err := loadProbesFile(os.Getenv("CUSTOM_PROBES_FILE"))
+		if err != nil {
+			return fmt.Errorf("loading probes file: %v", err)
+		}
+		probes = append(probes, extra...)
+	}
+
+	results := make([]probeResult, len(probes))
+	failed := false
+	for i, p := range probes {
+		results[i] = runProbe(r.Context(), p)
+		if results[i].Error != "" || results[i].Status < 200 || results[i].Status >= 300 {
+			failed = true
+		}
+	}
+
+	if failed {
+		w.WriteHeader(http.StatusFailedDependency)
+	}
+	return json.NewEncoder(w).Encode(results)
+}
+
+func loadProbesFile(path string) ([]probe, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var probes []probe
+	if err := json.Unmarshal(b, &probes); err != nil {
+		return nil, err
+	}
+	return probes, nil
+}
+
+// runProbe dispatches to a built-in round-trip check, or to a plain HTTP
+// probe if Verify isn't set.
+func runProbe(ctx context.Context, p probe) probeResult {
+	switch p.Verify {
+	case "logging":
+		return verifyLoggingRoundTrip(ctx, p)
+	case "monitoring":
+		return verifyMonitoringRoundTrip(ctx, p)
+	case "exception":
+		return verifyExceptionRoundTrip(ctx, p)
+	default:
+		return runHTTPProbe(ctx, p)
+	}
+}
+
+func probeTimeout(p probe) time.Duration {
+	ms := p.Timeout
+	if ms <= 0 {
+		ms = defaultProbeTimeoutMS
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// runHTTPProbe issues a GET against the probe's path and reports its
+// status, latency, and a hash of the response body.
+func runHTTPProbe(ctx context.Context, p probe) probeResult {
+	result := probeResult{Name: p.Name, Path: p.Path}
+	client := &http.Client{Timeout: probeTimeout(p)}
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:8080"+p.Path, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		recordProbeMetric(p.Name, "error", result.LatencyMs)
+		return result
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	sum := sha256.Sum256(body)
+	result.BodyHash = hex.EncodeToString(sum[:])
+
+	recordProbeMetric(p.Name, fmt.Sprintf("%d", result.Status), result.LatencyMs)
+	return result
+}
+
+// verifyLoggingRoundTrip posts a random token to /logging_custom, then
+// polls Stackdriver Logging via logadmin until the token shows up in the
+// log it was written to, or the probe's timeout elapses.
+func verifyLoggingRoundTrip(ctx context.Context, p probe) probeResult {
+	result := probeResult{Name: p.Name, Path: p.Path}
+	start := time.Now()
+
+	const logName = "postpush-verify"
+	token := randomToken()
+	payload, _ := json.Marshal(struct {
+		LogName string `json:"log_name"`
+		Token   string `json:"token"`
+	}{LogName: logName, Token: token})
+
+	resp, err := http.Post("http://localhost:8080"+p.Path, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+
+	deadline := time.Now().Add(probeTimeout(p))
+	filter := fmt.Sprintf(`logName = "projects/%s/logs/%s" AND jsonPayload.token = %q`, projectID, logName, token)
+	for time.Now().Before(deadline) {
+		it := logAdminClient.Entries(ctx, logadmin.Filter(filter), logadmin.NewestFirst())
+		if _, err := it.Next(); err == nil {
+			result.LatencyMs = time.Since(start).Milliseconds()
+			recordProbeMetric(p.Name, fmt.Sprintf("%d", result.Status), result.LatencyMs)
+			return result
+		} else if err != iterator.Done {
+			result.Error = err.Error()
+			return result
+		}
+		time.Sleep(probePollInterval)
+	}
+
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.Error = fmt.Sprintf("token did not appear in Stackdriver Logging within %s", probeTimeout(p))
+	return result
+}
+
+// verifyMonitoringRoundTrip posts a random token to /monitoring, forces a
+// batcher flush, then polls Cloud Monitoring via ListTimeSeries until the
+// token shows up as a point, or the probe's timeout elapses.
+func verifyMonitoringRoundTrip(ctx context.Context, p probe) probeResult {
+	result := probeResult{Name: p.Name, Path: p.Path}
+	start := time.Now()
+
+	const metricType = "custom.googleapis.com/postpush/verify"
+	token := rand.Int63()
+	payload, _ := json.Marshal(struct {
+		Name  string `json:"name"`
+		Token int64  `json:"token"`
+	}{Name: metricType, Token: token})
+
+	resp, err := http.Post("http://localhost:8080"+p.Path, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+
+	if err := metricsBatcher.Flush(ctx); err != nil {
+		result.Error = fmt.Sprintf("flushing metrics before verify: %v", err)
+		return result
+	}
+
+	windowStart, _ := ptypes.TimestampProto(time.Now().Add(-10 * time.Minute))
+	windowEnd, _ := ptypes.TimestampProto(time.Now())
+
+	deadline := time.Now().Add(probeTimeout(p))
+	for time.Now().Before(deadline) {
+		it := mtClient.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+			Name:   monitoring.MetricProjectPath(projectID),
+			Filter: fmt.Sprintf(`metric.type = %q`, metricType),
+			Interval: &monitoringpb.TimeInterval{
+				StartTime: windowStart,
+				EndTime:   windowEnd,
+			},
+			View: monitoringpb.ListTimeSeriesRequest_FULL,
+		})
+		found := false
+	seriesLoop:
+		for {
+			ts, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				result.Error = err.Error()
+				return result
+			}
+			for _, pt := range ts.Points {
+				if pt.GetValue().GetInt64Value() == token {
+					found = true
+					break seriesLoop
+				}
+			}
+		}
+		if found {
+			result.LatencyMs = time.Since(start).Milliseconds()
+			recordProbeMetric(p.Name, fmt.Sprintf("%d", result.Status), result.LatencyMs)
+			return result
+		}
+		time.Sleep(probePollInterval)
+	}
+
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.Error = fmt.Sprintf("token did not appear in Cloud Monitoring within %s", probeTimeout(p))
+	return result
+}
+
+// verifyExceptionRoundTrip posts a random token to /exception, then polls
+// Error Reporting via errStatsClient until an event carrying the token shows
+// up under the "default" service, or the probe's timeout elapses.
+func verifyExceptionRoundTrip(ctx context.Context, p probe) probeResult {
+	result := probeResult{Name: p.Name, Path: p.Path}
+	start := time.Now()
+
+	token := rand.Int63()
+	payload, _ := json.Marshal(struct {
+		Token int64 `json:"token"`
+	}{Token: token})
+
+	resp, err := http.Post("http://localhost:8080"+p.Path, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+
+	want := fmt.Sprintf("%d", token)
+	projectName := fmt.Sprintf("projects/%s", projectID)
+	timeRange := &clouderrorreportingpb.QueryTimeRange{Period: clouderrorreportingpb.QueryTimeRange_PERIOD_1_HOUR}
+
+	deadline := time.Now().Add(probeTimeout(p))
+	for time.Now().Before(deadline) {
+		found, err := exceptionTokenReported(ctx, projectName, timeRange, want)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if found {
+			result.LatencyMs = time.Since(start).Milliseconds()
+			recordProbeMetric(p.Name, fmt.Sprintf("%d", result.Status), result.LatencyMs)
+			return result
+		}
+		time.Sleep(probePollInterval)
+	}
+
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.Error = fmt.Sprintf("token did not appear in Error Reporting within %s", probeTimeout(p))
+	return result
+}
+
+// exceptionTokenReported checks the "default" service's error groups for an
+// event whose message contains token, within timeRange.
+func exceptionTokenReported(ctx context.Context, projectName string, timeRange *clouderrorreportingpb.QueryTimeRange, token string) (bool, error) {
+	groupIt := errStatsClient.ListGroupStats(ctx, &clouderrorreportingpb.ListGroupStatsRequest{
+		ProjectName:   projectName,
+		ServiceFilter: &clouderrorreportingpb.ServiceContextFilter{Service: "default"},
+		TimeRange:     timeRange,
+	})
+	for {
+		group, err := groupIt.Next()
+		if err == iterator.Done {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		eventIt := errStatsClient.ListEvents(ctx, &clouderrorreportingpb.ListEventsRequest{
+			ProjectName: projectName,
+			GroupId:     group.Group.GroupId,
+			TimeRange:   timeRange,
+		})
+		for {
+			event, err := eventIt.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return false, err
+			}
+			if strings.Contains(event.Message, token) {
+				return true, nil
+			}
+		}
+	}
+}
+
+// recordProbeMetric enqueues a probe_latency_ms point labeled by probe name
+// and status, so probe health is itself visible as a Stackdriver metric.
+func recordProbeMetric(name, status string, latencyMs int64) {
+	metricsBatcher.Register(probeLatencyMetric, metricpb.MetricDescriptor_GAUGE, metricpb.MetricDescriptor_INT64)
+	metricsBatcher.Enqueue(probeLatencyMetric, res.Monitored, map[string]string{
+		"name":   name,
+		"status": status,
+	}, &monitoringpb.TypedValue{
+		Value: &monitoringpb.TypedValue_Int64Value{Int64Value: latencyMs},
+	})
+}
+
+func randomToken() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	clientsReady int32 // set once all Stackdriver clients have been constructed
+	shuttingDown int32 // set once the shutdown sequence has started
+)
+
+func markClientsReady() { atomic.StoreInt32(&clientsReady, 1) }
+func markShuttingDown()  { atomic.StoreInt32(&shuttingDown, 1) }
+
+// liveHandler backs /_ah/live: it reports OK as soon as the process is up,
+// regardless of whether it can yet talk to Stackdriver.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "OK")
+}
+
+// readyHandler backs /_ah/ready: it reports OK only once the Stackdriver
+// clients are constructed and the metric batcher has completed at least
+// one flush without error (an empty flush counts, see Batcher.Flushed), and
+// goes back to 503 once shutdown begins so a load balancer stops sending new
+// traffic during the drain.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if atomic.LoadInt32(&clientsReady) == 0 || !metricsBatcher.Flushed() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
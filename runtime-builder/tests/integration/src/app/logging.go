@@ -0,0 +1,174 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"go.opencensus.io/trace"
+)
+
+// traceContextHeader is the header Cloud Trace and the Stackdriver agents use
+// to propagate trace context: "TRACE_ID/SPAN_ID;o=TRACE_TRUE".
+const traceContextHeader = "X-Cloud-Trace-Context"
+
+// parseTraceContext parses the X-Cloud-Trace-Context header and returns the
+// fully-qualified trace name and span ID expected by logging.Entry. The
+// span ID is re-encoded as the 16-character hex string Cloud Logging
+// expects, the same encoding tracing.go's remoteSpanContext uses, so log
+// entries actually correlate with their trace's span in Cloud Console.
+// parseTraceContext returns empty strings if the header is absent or its
+// trace ID part (everything before the first '/', or the whole header if
+// there is none) is empty; the trace ID is not otherwise validated. spanID
+// is empty if the span ID part is missing or not a decimal number.
+func parseTraceContext(r *http.Request) (trace, spanID string) {
+	h := r.Header.Get(traceContextHeader)
+	if h == "" {
+		return "", ""
+	}
+	traceID := h
+	var rawSpanID string
+	if i := strings.IndexByte(h, '/'); i >= 0 {
+		traceID = h[:i]
+		rest := h[i+1:]
+		if j := strings.IndexByte(rest, ';'); j >= 0 {
+			rawSpanID = rest[:j]
+		} else {
+			rawSpanID = rest
+		}
+	}
+	if traceID == "" {
+		return "", ""
+	}
+	if spanIDUint, err := strconv.ParseUint(rawSpanID, 10, 64); err == nil {
+		spanID = fmt.Sprintf("%016x", spanIDUint)
+	}
+	return fmt.Sprintf("projects/%s/traces/%s", projectID, traceID), spanID
+}
+
+// newLogEntry builds a logging.Entry for the current request, auto-populating
+// HTTPRequest, Trace, and SpanID from the incoming request (and its
+// X-Cloud-Trace-Context header, if any) so handlers don't have to repeat
+// that logic.
+func newLogEntry(r *http.Request, severity logging.Severity, payload interface{}, labels map[string]string) logging.Entry {
+	trace, spanID := parseTraceContext(r)
+	return logging.Entry{
+		Timestamp:   time.Now(),
+		Severity:    severity,
+		Payload:     payload,
+		Labels:      mergeLabels(res.Labels, labels),
+		Trace:       trace,
+		SpanID:      spanID,
+		Resource:    res.Monitored,
+		HTTPRequest: &logging.HTTPRequest{Request: r},
+	}
+}
+
+// mergeLabels combines the process-level resource labels with per-entry
+// overrides, giving the latter priority.
+func mergeLabels(base, overrides map[string]string) map[string]string {
+	if len(base) == 0 {
+		return overrides
+	}
+	merged := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// stackdriverWriter adapts a Stackdriver logging.Logger to io.Writer so it
+// can be used as one of the destinations of a MultiWriter. Every write is
+// logged as a single Entry at the configured severity.
+type stackdriverWriter struct {
+	logger   *logging.Logger
+	severity logging.Severity
+}
+
+func (w stackdriverWriter) Write(p []byte) (int, error) {
+	w.logger.Log(logging.Entry{
+		Timestamp: time.Now(),
+		Severity:  w.severity,
+		Payload:   strings.TrimRight(string(p), "\n"),
+	})
+	return len(p), nil
+}
+
+// mirrorStandardLog makes the process's default `log` package output go to
+// both os.Stderr and the given Stackdriver logger at Info severity, so
+// anything logged with log.Print/log.Fatal et al. also shows up in
+// Stackdriver Logging.
+func mirrorStandardLog(lg *logging.Logger) {
+	log.SetOutput(io.MultiWriter(os.Stderr, stackdriverWriter{logger: lg, severity: logging.Info}))
+}
+
+// customLoggingHandler writes a structured logging.Entry to the log named by
+// LogName. Payload carries arbitrary key/value data; Labels, Trace, SpanID,
+// and Severity may be supplied explicitly, and Trace/SpanID otherwise default
+// to whatever the request's X-Cloud-Trace-Context header carries.
+func customLoggingHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("wrong request method: %v, requires POST", r.Method)
+	}
+	decoder := json.NewDecoder(r.Body)
+	var b struct {
+		LogName string                 `json:"log_name"`
+		Token   string                 `json:"token"`
+		Level   string                 `json:"level"`
+		Payload map[string]interface{} `json:"payload"`
+		Labels  map[string]string      `json:"labels"`
+		Trace   string                 `json:"trace"`
+		SpanID  string                 `json:"span_id"`
+	}
+	if err := decoder.Decode(&b); err != nil {
+		return fmt.Errorf("decode request body: %v", err)
+	}
+	r.Body.Close()
+
+	payload := b.Payload
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	if b.Token != "" {
+		payload["token"] = b.Token
+	}
+
+	entry := newLogEntry(r, logging.ParseSeverity(b.Level), payload, b.Labels)
+	if b.Trace != "" {
+		entry.Trace = b.Trace
+	}
+	if b.SpanID != "" {
+		entry.SpanID = b.SpanID
+	}
+
+	_, span := trace.StartSpan(r.Context(), "logging.Log")
+	lgClient.Logger(b.LogName).Log(entry)
+	span.End()
+
+	_, err := fmt.Fprint(w, "OK")
+	return err
+}
@@ -0,0 +1,353 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	distributionpb "google.golang.org/genproto/googleapis/api/distribution"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxTimeSeriesPerRequest is Stackdriver's per-CreateTimeSeries-call limit.
+	maxTimeSeriesPerRequest = 200
+	defaultFlushInterval    = 10 * time.Second
+	maxFlushBackoff         = 30 * time.Second
+	maxFlushAttempts        = 5
+)
+
+// seriesKey identifies one (metric type, resource, label-set) time series so
+// points for the same series get batched together.
+type seriesKey struct {
+	metricType  string
+	resourceKey string
+	labelsKey   string
+}
+
+// seriesMeta is registered once per metric type so every point written for
+// it gets the right MetricKind/ValueType, and so a CUMULATIVE series carries
+// a StartTime that stays stable across writes.
+type seriesMeta struct {
+	kind      metricpb.MetricDescriptor_MetricKind
+	valueType metricpb.MetricDescriptor_ValueType
+	startTime *timestamp.Timestamp
+}
+
+type bufferedSeries struct {
+	metricType   string
+	metricLabels map[string]string
+	resource     *monitoredrespb.MonitoredResource
+	meta         seriesMeta
+	points       []*monitoringpb.Point
+}
+
+// Batcher buffers metric points per (metric type, resource, label-set) key
+// and flushes them to Stackdriver Monitoring from a background goroutine,
+// retrying transient errors up to maxFlushAttempts times. Points in a chunk
+// that still fails, or fails with a non-retryable error, are dropped.
+type Batcher struct {
+	client      *monitoring.MetricClient
+	projectName string
+
+	mu       sync.Mutex
+	buf      map[seriesKey]*bufferedSeries
+	registry map[string]seriesMeta
+
+	flushInterval time.Duration
+	flushedOnce   bool
+}
+
+// NewBatcher creates a Batcher that writes time series for projectID via
+// client. Callers must start its background loop with Run.
+func NewBatcher(client *monitoring.MetricClient, projectID string) *Batcher {
+	return &Batcher{
+		client:        client,
+		projectName:   monitoring.MetricProjectPath(projectID),
+		buf:           make(map[seriesKey]*bufferedSeries),
+		registry:      make(map[string]seriesMeta),
+		flushInterval: defaultFlushInterval,
+	}
+}
+
+// Register records the kind/value type metricType should use. It's a no-op
+// if metricType is already registered, so the first caller wins and a
+// CUMULATIVE series keeps a single, stable StartTime for its lifetime.
+func (b *Batcher) Register(metricType string, kind metricpb.MetricDescriptor_MetricKind, valueType metricpb.MetricDescriptor_ValueType) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.registry[metricType]; ok {
+		return
+	}
+	meta := seriesMeta{kind: kind, valueType: valueType}
+	if kind == metricpb.MetricDescriptor_CUMULATIVE {
+		meta.startTime = ptypes.TimestampNow()
+	}
+	b.registry[metricType] = meta
+}
+
+// Enqueue buffers a point for metricType/resource/metricLabels and returns
+// immediately; Run's background loop is responsible for writing it out.
+// Register should be called first for anything other than a plain
+// GAUGE/INT64 metric.
+func (b *Batcher) Enqueue(metricType string, resource *monitoredrespb.MonitoredResource, metricLabels map[string]string, value *monitoringpb.TypedValue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	meta, ok := b.registry[metricType]
+	if !ok {
+		meta = seriesMeta{kind: metricpb.MetricDescriptor_GAUGE, valueType: metricpb.MetricDescriptor_INT64}
+		b.registry[metricType] = meta
+	}
+
+	key := seriesKey{metricType: metricType, resourceKey: resourceKey(resource), labelsKey: labelsKey(metricLabels)}
+	s, ok := b.buf[key]
+	if !ok {
+		s = &bufferedSeries{metricType: metricType, metricLabels: metricLabels, resource: resource, meta: meta}
+		b.buf[key] = s
+	}
+
+	interval := &monitoringpb.TimeInterval{EndTime: ptypes.TimestampNow()}
+	if meta.kind == metricpb.MetricDescriptor_CUMULATIVE {
+		interval.StartTime = meta.startTime
+	}
+	// CreateTimeSeries accepts at most one point per TimeSeries per request,
+	// so the most recent write for this series wins rather than piling up
+	// points that Stackdriver would reject wholesale at the next Flush.
+	s.points = []*monitoringpb.Point{{Interval: interval, Value: value}}
+
+	if len(b.buf) >= maxTimeSeriesPerRequest {
+		go func() {
+			if err := b.Flush(context.Background()); err != nil {
+				reportBatcherError(context.Background(), err)
+			}
+		}()
+	}
+}
+
+// Run drains the batcher on a timer until ctx is cancelled, flushing once
+// more on the way out so a shutdown doesn't lose the tail of a batch.
+func (b *Batcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.Flush(context.Background())
+			return
+		case <-ticker.C:
+			if err := b.Flush(ctx); err != nil {
+				reportBatcherError(ctx, err)
+			}
+		}
+	}
+}
+
+// Flush drains the currently buffered series and writes them to Stackdriver
+// in chunks of at most maxTimeSeriesPerRequest, retrying transient errors
+// with exponential backoff and jitter. It returns the first error it
+// couldn't recover from, if any.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	pending := b.buf
+	b.buf = make(map[seriesKey]*bufferedSeries)
+	b.mu.Unlock()
+
+	if len(pending) == 0 {
+		// Nothing buffered is a no-op, not a failure: readiness shouldn't
+		// depend on handler traffic having enqueued a point first.
+		b.mu.Lock()
+		b.flushedOnce = true
+		b.mu.Unlock()
+		return nil
+	}
+
+	series := make([]*monitoringpb.TimeSeries, 0, len(pending))
+	for _, s := range pending {
+		series = append(series, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: s.metricType, Labels: s.metricLabels},
+			Resource:   s.resource,
+			MetricKind: s.meta.kind,
+			ValueType:  s.meta.valueType,
+			Points:     s.points,
+		})
+	}
+
+	var firstErr error
+	for i := 0; i < len(series); i += maxTimeSeriesPerRequest {
+		end := i + maxTimeSeriesPerRequest
+		if end > len(series) {
+			end = len(series)
+		}
+		if err := b.writeWithRetry(ctx, series[i:end]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	b.mu.Lock()
+	if firstErr == nil {
+		b.flushedOnce = true
+	}
+	b.mu.Unlock()
+	return firstErr
+}
+
+// writeWithRetry calls CreateTimeSeries, retrying on Unavailable and
+// ResourceExhausted with exponential backoff (capped at maxFlushBackoff)
+// plus jitter, up to maxFlushAttempts.
+func (b *Batcher) writeWithRetry(ctx context.Context, series []*monitoringpb.TimeSeries) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := b.client.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{
+			Name:       b.projectName,
+			TimeSeries: series,
+		})
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxFlushAttempts || !isRetryableWriteErr(err) {
+			return fmt.Errorf("writing time series data: %v", err)
+		}
+		select {
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > maxFlushBackoff {
+			backoff = maxFlushBackoff
+		}
+	}
+}
+
+func isRetryableWriteErr(err error) bool {
+	s, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch s.Code() {
+	case codes.Unavailable, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// Flushed reports whether the batcher has completed at least one flush
+// without error since startup. A flush with nothing buffered counts, so this
+// can be true before any point has been written.
+func (b *Batcher) Flushed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushedOnce
+}
+
+// resourceKey serializes a MonitoredResource's type and labels into a
+// stable string so it can be used as (part of) a map key.
+func resourceKey(r *monitoredrespb.MonitoredResource) string {
+	if r == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(r.Labels))
+	for k := range r.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(r.Type)
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "|%s=%s", k, r.Labels[k])
+	}
+	return sb.String()
+}
+
+// labelsKey serializes a metric label set into a stable string so it can be
+// used as (part of) a map key.
+func labelsKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "|%s=%s", k, labels[k])
+	}
+	return sb.String()
+}
+
+// reportBatcherError surfaces a background flush failure via Error
+// Reporting so it's visible even though nothing is waiting on the request
+// that originally enqueued the point.
+func reportBatcherError(ctx context.Context, err error) {
+	if errClient != nil {
+		errClient.Report(ctx, nil, err)
+	}
+}
+
+// newDistribution builds a minimal valid Distribution from raw sample
+// values using a single explicit bucket, so samples can be reported without
+// needing pre-registered bucket boundaries.
+func newDistribution(samples []float64) *distributionpb.Distribution {
+	var sum, sumSquaredDeviation float64
+	for _, v := range samples {
+		sum += v
+	}
+	mean := sum / float64(len(samples))
+	for _, v := range samples {
+		d := v - mean
+		sumSquaredDeviation += d * d
+	}
+	return &distributionpb.Distribution{
+		Count:                 int64(len(samples)),
+		Mean:                  mean,
+		SumOfSquaredDeviation: sumSquaredDeviation,
+		BucketOptions: &distributionpb.Distribution_BucketOptions{
+			Options: &distributionpb.Distribution_BucketOptions_ExplicitBuckets{
+				ExplicitBuckets: &distributionpb.Distribution_BucketOptions_Explicit{
+					Bounds: []float64{0},
+				},
+			},
+		},
+		BucketCounts: []int64{0, int64(len(samples))},
+	}
+}
+
+// metricsFlushHandler forces an immediate drain of the metric batcher; it's
+// a debug aid for verifying points made it to Stackdriver without waiting
+// for the next scheduled flush.
+func metricsFlushHandler(w http.ResponseWriter, r *http.Request) error {
+	if err := metricsBatcher.Flush(r.Context()); err != nil {
+		return fmt.Errorf("flushing metrics: %v", err)
+	}
+	_, err := fmt.Fprint(w, "OK")
+	return err
+}
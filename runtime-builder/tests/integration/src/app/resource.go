@@ -0,0 +1,171 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// resource describes where this process is running: a Stackdriver
+// MonitoredResource to attach to metrics and log entries, plus a looser set
+// of common labels (container/instance identifiers, image info, ...) that
+// don't fit the fixed MonitoredResource label schema but are still useful
+// to carry on log entries.
+type resource struct {
+	Monitored *monitoredrespb.MonitoredResource
+	Labels    map[string]string
+}
+
+// cgroupContainerIDPattern matches a 64-character container ID anywhere in a
+// /proc/self/cgroup line, which is how Docker (and most container runtimes
+// that reuse cgroupfs) expose the running container's ID.
+var cgroupContainerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// detectResource inspects the runtime environment and returns the
+// MonitoredResource (GCE, GKE, Cloud Run, App Engine Flex, or a plain-Docker
+// "global" fallback) this process is running under, along with any
+// additional labels worth attaching to logs.
+func detectResource(ctx context.Context) *resource {
+	if !metadata.OnGCE() {
+		return detectDockerResource()
+	}
+
+	instanceID, _ := metadata.InstanceID()
+	zone, _ := metadata.Zone()
+
+	switch {
+	case os.Getenv("K_SERVICE") != "":
+		return &resource{
+			Monitored: &monitoredrespb.MonitoredResource{
+				Type: "cloud_run_revision",
+				Labels: map[string]string{
+					"project_id":         projectID,
+					"service_name":       os.Getenv("K_SERVICE"),
+					"revision_name":      os.Getenv("K_REVISION"),
+					"configuration_name": os.Getenv("K_CONFIGURATION"),
+					"location":           regionFromZone(zone),
+				},
+			},
+		}
+	case os.Getenv("GAE_SERVICE") != "":
+		return &resource{
+			Monitored: &monitoredrespb.MonitoredResource{
+				Type: "gae_app",
+				Labels: map[string]string{
+					"project_id": projectID,
+					"module_id":  os.Getenv("GAE_SERVICE"),
+					"version_id": os.Getenv("GAE_VERSION"),
+					"zone":       regionFromZone(zone),
+				},
+			},
+		}
+	case isGKE():
+		namespace := strings.TrimSpace(readFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"))
+		clusterName, _ := metadata.InstanceAttributeValue("cluster-name")
+		return &resource{
+			Monitored: &monitoredrespb.MonitoredResource{
+				Type: "k8s_container",
+				Labels: map[string]string{
+					"project_id":     projectID,
+					"location":       zone,
+					"cluster_name":   clusterName,
+					"namespace_name": namespace,
+					"pod_name":       os.Getenv("POD_NAME"),
+					"container_name": os.Getenv("CONTAINER_NAME"),
+				},
+			},
+		}
+	default:
+		instanceName, _ := metadata.InstanceName()
+		return &resource{
+			Monitored: &monitoredrespb.MonitoredResource{
+				Type: "gce_instance",
+				Labels: map[string]string{
+					"project_id":  projectID,
+					"instance_id": instanceID,
+					"zone":        zone,
+				},
+			},
+			Labels: map[string]string{
+				"instance_name": instanceName,
+			},
+		}
+	}
+}
+
+// regionFromZone trims a zone's single-letter suffix ("us-central1-b") down
+// to its region ("us-central1"), which is what the cloud_run_revision and
+// gae_app MonitoredResource schemas expect despite the metadata server only
+// exposing a zone.
+func regionFromZone(zone string) string {
+	i := strings.LastIndex(zone, "-")
+	if i < 0 || i == len(zone)-1 {
+		return zone
+	}
+	return zone[:i]
+}
+
+// isGKE reports whether the process is running inside a GKE pod, which
+// mounts a service account namespace file that's absent on plain GCE and on
+// Cloud Run/App Engine Flex.
+func isGKE() bool {
+	_, err := os.Stat("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	return err == nil
+}
+
+// detectDockerResource handles the non-GCE case: a container running under
+// plain Docker (e.g. on a developer's machine or a non-GCP host). There's no
+// Stackdriver MonitoredResource type for an arbitrary Docker host, so we fall
+// back to "global" and instead attach the same label set the Docker gcplogs
+// logging driver attaches, read from /proc/self/cgroup and the environment.
+func detectDockerResource() *resource {
+	labels := map[string]string{
+		"container_id":   containerID(),
+		"container_name": os.Getenv("HOSTNAME"),
+		"image_name":     os.Getenv("IMAGE_NAME"),
+		"image_id":       os.Getenv("IMAGE_ID"),
+	}
+	return &resource{
+		Monitored: &monitoredrespb.MonitoredResource{
+			Type: "global",
+			Labels: map[string]string{
+				"project_id": projectID,
+			},
+		},
+		Labels: labels,
+	}
+}
+
+// containerID extracts the running container's ID from /proc/self/cgroup,
+// mirroring how the Docker gcplogs driver identifies the container.
+func containerID() string {
+	contents := readFile("/proc/self/cgroup")
+	return cgroupContainerIDPattern.FindString(contents)
+}
+
+func readFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -24,17 +24,20 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
+	errorstats "cloud.google.com/go/errorreporting/apiv1beta1"
 	"cloud.google.com/go/errors"
 	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/logadmin"
 	monitoring "cloud.google.com/go/monitoring/apiv3"
-	"github.com/golang/protobuf/ptypes"
+	"go.opencensus.io/trace"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
-	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
@@ -47,10 +50,14 @@ func (h appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 var (
-	projectID string
-	lgClient  *logging.Client
-	mtClient  *monitoring.MetricClient
-	errClient *errors.Client
+	projectID      string
+	lgClient       *logging.Client
+	logAdminClient *logadmin.Client
+	mtClient       *monitoring.MetricClient
+	errClient      *errors.Client
+	errStatsClient *errorstats.ErrorStatsClient
+	res            *resource
+	metricsBatcher *Batcher
 )
 
 func main() {
@@ -63,29 +70,101 @@ func main() {
 		projectID = os.Getenv("PROJECT_ID")
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize Stackdriver API clients
-	ctx := context.Background()
-	if lgClient, err = logging.NewClient(ctx, projectID); err != nil {
+	res = detectResource(ctx)
+
+	traceFlush, err := initTracing(projectID)
+	if err != nil {
+		log.Fatalf("failed to initialize tracing: %v", err)
+	}
+	defer traceFlush()
+
+	if lgClient, err = logging.NewClient(ctx, projectID, tracingDialOption); err != nil {
 		log.Fatalf("failed to create logging client: %v", err)
 	}
-	if mtClient, err = monitoring.NewMetricClient(ctx); err != nil {
+	lgClient.OnError = func(err error) {
+		fmt.Fprintf(os.Stderr, "logging: async flush error: %v\n", err)
+	}
+	mirrorStandardLog(lgClient.Logger("stdlog"))
+	if logAdminClient, err = logadmin.NewClient(ctx, projectID, tracingDialOption); err != nil {
+		log.Fatalf("failed to create logging admin client: %v", err)
+	}
+	if mtClient, err = monitoring.NewMetricClient(ctx, tracingDialOption); err != nil {
 		log.Fatalf("failed to create metric client: %v", err)
 	}
-	if errClient, err = errors.NewClient(ctx, projectID, "default", "", false); err != nil {
+	metricsBatcher = NewBatcher(mtClient, projectID)
+	// The batcher runs on its own cancellation, not ctx: stopping it the
+	// instant SIGTERM arrives would flush once and exit before srv.Shutdown
+	// finishes draining in-flight requests, losing any point a handler
+	// enqueues during that drain window.
+	batcherCtx, stopBatcher := context.WithCancel(context.Background())
+	batcherDone := make(chan struct{})
+	go func() {
+		metricsBatcher.Run(batcherCtx)
+		close(batcherDone)
+	}()
+	if errClient, err = errors.NewClient(ctx, projectID, "default", "", false, tracingDialOption); err != nil {
 		log.Fatalf("failed to create error reporting client: %v", err)
 	}
+	if errStatsClient, err = errorstats.NewErrorStatsClient(ctx, tracingDialOption); err != nil {
+		log.Fatalf("failed to create error stats client: %v", err)
+	}
+	markClientsReady()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", tracingMiddleware("/", http.HandlerFunc(mainHandler)))
+	mux.HandleFunc("/_ah/live", liveHandler)
+	mux.HandleFunc("/_ah/ready", readyHandler)
+	mux.Handle("/version", tracingMiddleware("/version", http.HandlerFunc(versionHandler)))
+	mux.Handle("/tzinfo", tracingMiddleware("/tzinfo", appHandler(tzinfoHandler)))
+	mux.Handle("/lookup_host", tracingMiddleware("/lookup_host", appHandler(lookupHostHandler)))
+	mux.Handle("/logging_custom", tracingMiddleware("/logging_custom", appHandler(customLoggingHandler)))
+	mux.Handle("/monitoring", tracingMiddleware("/monitoring", appHandler(monitoringHandler)))
+	mux.Handle("/exception", tracingMiddleware("/exception", appHandler(exceptionHandler)))
+	mux.Handle("/custom", tracingMiddleware("/custom", appHandler(customHandler)))
+	mux.Handle("/metrics/flush", tracingMiddleware("/metrics/flush", appHandler(metricsFlushHandler)))
+
+	srv := &http.Server{Addr: ":8080", Handler: mux}
+	go func() {
+		log.Print("Listening on port 8080")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("ListenAndServe: %v", err)
+		}
+	}()
 
-	http.HandleFunc("/", mainHandler)
-	http.HandleFunc("/_ah/health", healthCheckHandler)
-	http.HandleFunc("/version", versionHandler)
-	http.Handle("/tzinfo", appHandler(tzinfoHandler))
-	http.Handle("/lookup_host", appHandler(lookupHostHandler))
-	http.Handle("/logging_custom", appHandler(customLoggingHandler))
-	http.Handle("/monitoring", appHandler(monitoringHandler))
-	http.Handle("/exception", appHandler(exceptionHandler))
-	http.Handle("/custom", appHandler(customHandler))
-	log.Print("Listening on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	<-ctx.Done()
+	stop()
+	log.Print("shutting down")
+	markShuttingDown()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod())
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+
+	stopBatcher() // only now safe to let the batcher flush and exit
+	<-batcherDone // wait for the batcher's final flush before closing mtClient
+	lgClient.Close()
+	logAdminClient.Close()
+	mtClient.Close()
+	errClient.Close()
+	errStatsClient.Close()
+}
+
+// shutdownGracePeriod is how long Shutdown waits for in-flight requests to
+// finish, configurable via SHUTDOWN_GRACE_PERIOD (a duration string like
+// "15s"); it defaults to 10s.
+func shutdownGracePeriod() time.Duration {
+	const def = 10 * time.Second
+	d, err := time.ParseDuration(os.Getenv("SHUTDOWN_GRACE_PERIOD"))
+	if err != nil {
+		return def
+	}
+	return d
 }
 
 func mainHandler(w http.ResponseWriter, r *http.Request) {
@@ -96,10 +175,6 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Hello World!")
 }
 
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, "OK")
-}
-
 func versionHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Go version=%s\nGOARCH=%s\nGOOS=%s\n", runtime.Version(), runtime.GOARCH, runtime.GOOS)
 }
@@ -114,6 +189,9 @@ func tzinfoHandler(w http.ResponseWriter, r *http.Request) error {
 }
 
 func lookupHostHandler(w http.ResponseWriter, r *http.Request) error {
+	_, span := trace.StartSpan(r.Context(), "lookupHost")
+	defer span.End()
+
 	addrs, err := net.LookupHost(r.Host)
 	if err != nil {
 		return fmt.Errorf("error lookup host: %v", err)
@@ -122,74 +200,45 @@ func lookupHostHandler(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func customLoggingHandler(w http.ResponseWriter, r *http.Request) error {
+func monitoringHandler(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
 		return fmt.Errorf("wrong request method: %v, requires POST", r.Method)
 	}
 	decoder := json.NewDecoder(r.Body)
 	var b struct {
-		LogName string `json:"log_name"`
-		Token   string `json:"token"`
-		Level   string `json:"level"`
+		Name         string    `json:"name"`
+		Token        int64     `json:"token"`
+		Kind         string    `json:"kind"`         // "GAUGE" (default) or "CUMULATIVE"
+		Distribution []float64 `json:"distribution"` // sample values; non-empty makes this a DISTRIBUTION metric
 	}
 	if err := decoder.Decode(&b); err != nil {
 		return fmt.Errorf("decode request body: %v", err)
 	}
 	r.Body.Close()
 
-	lg := lgClient.Logger(b.LogName)
-	slg := lg.StandardLogger(logging.ParseSeverity(b.Level))
-	slg.Println(b.Token)
-	return nil
-}
-
-func monitoringHandler(w http.ResponseWriter, r *http.Request) error {
-	if r.Method != http.MethodPost {
-		return fmt.Errorf("wrong request method: %v, requires POST", r.Method)
+	kind := metricpb.MetricDescriptor_GAUGE
+	if b.Kind == "CUMULATIVE" {
+		kind = metricpb.MetricDescriptor_CUMULATIVE
 	}
-	decoder := json.NewDecoder(r.Body)
-	var b struct {
-		Name  string `json:"name"`
-		Token int64  `json:"token"`
-	}
-	if err := decoder.Decode(&b); err != nil {
-		return fmt.Errorf("decode request body: %v", err)
-	}
-	r.Body.Close()
 
-	p := &monitoringpb.Point{
-		Interval: &monitoringpb.TimeInterval{
-			EndTime: ptypes.TimestampNow(),
-		},
-		Value: &monitoringpb.TypedValue{
-			Value: &monitoringpb.TypedValue_Int64Value{
-				Int64Value: b.Token,
-			},
-		},
-	}
-
-	if err := mtClient.CreateTimeSeries(r.Context(), &monitoringpb.CreateTimeSeriesRequest{
-		Name: monitoring.MetricProjectPath(projectID),
-		TimeSeries: []*monitoringpb.TimeSeries{
-			{
-				Metric: &metricpb.Metric{
-					Type: b.Name,
-				},
-				Resource: &monitoredrespb.MonitoredResource{
-					Type: "global",
-					Labels: map[string]string{
-						"project_id": projectID,
-					},
-				},
-				Points: []*monitoringpb.Point{
-					p,
-				},
+	valueType := metricpb.MetricDescriptor_INT64
+	value := &monitoringpb.TypedValue{
+		Value: &monitoringpb.TypedValue_Int64Value{Int64Value: b.Token},
+	}
+	if len(b.Distribution) > 0 {
+		valueType = metricpb.MetricDescriptor_DISTRIBUTION
+		value = &monitoringpb.TypedValue{
+			Value: &monitoringpb.TypedValue_DistributionValue{
+				DistributionValue: newDistribution(b.Distribution),
 			},
-		},
-	}); err != nil {
-		return fmt.Errorf("writing time series data: %v", err)
+		}
 	}
 
+	_, span := trace.StartSpan(r.Context(), "monitoring.Enqueue")
+	metricsBatcher.Register(b.Name, kind, valueType)
+	metricsBatcher.Enqueue(b.Name, res.Monitored, nil, value)
+	span.End()
+
 	_, err := fmt.Fprint(w, "OK")
 	return err
 }
@@ -207,29 +256,10 @@ func exceptionHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 	r.Body.Close()
 
-	errClient.Report(r.Context(), r, b.Token)
+	ctx, span := trace.StartSpan(r.Context(), "errors.Report")
+	errClient.Report(ctx, r, b.Token)
+	span.End()
+
 	_, err := fmt.Fprint(w, "OK")
 	return err
 }
-
-func customHandler(w http.ResponseWriter, r *http.Request) error {
-	var tests = []struct {
-		Name    string `json:"name,omitempty"`
-		Path    string `json:"path,omitempty"`
-		Timeout int    `json:"timeout,omitempty"`
-	}{
-		{
-			Name: "Version",
-			Path: "/version",
-		},
-		{
-			Name: "Lookup Host",
-			Path: "/lookup_host",
-		},
-		{
-			Name: "TimeZone",
-			Path: "/tzinfo",
-		},
-	}
-	return json.NewEncoder(w).Encode(tests)
-}
@@ -0,0 +1,163 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is deliberately self-contained: it only depends on the standard
+// library, OpenCensus, gRPC, and the Google API client's option package, and
+// could be lifted into its own package
+// without touching anything else in this app.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	texporter "contrib.go.opencensus.io/exporter/stackdriver"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+const defaultTraceSampleRatio = 0.1
+
+// initTracing registers a Cloud Trace exporter for projectID and sets the
+// global sampler from TRACE_SAMPLE_RATIO (default 0.1). It returns a flush
+// func that should be called during shutdown so buffered spans aren't lost.
+func initTracing(projectID string) (flush func(), err error) {
+	exporter, err := texporter.NewExporter(texporter.Options{ProjectID: projectID})
+	if err != nil {
+		return nil, err
+	}
+	trace.RegisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(traceSampleRatio())})
+	return exporter.Flush, nil
+}
+
+func traceSampleRatio() float64 {
+	ratio, err := strconv.ParseFloat(os.Getenv("TRACE_SAMPLE_RATIO"), 64)
+	if err != nil {
+		return defaultTraceSampleRatio
+	}
+	return ratio
+}
+
+// tracingMiddleware starts a span per request named after route, records
+// the standard OpenCensus HTTP attributes, and continues the trace named by
+// the request's X-Cloud-Trace-Context header (if any) instead of starting a
+// new one, so a single trace covers the full caller -> this service path.
+func tracingMiddleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var span *trace.Span
+		if sc, ok := remoteSpanContext(r); ok {
+			ctx, span = trace.StartSpanWithRemoteParent(ctx, route, sc)
+		} else {
+			ctx, span = trace.StartSpan(ctx, route)
+		}
+		defer span.End()
+
+		span.AddAttributes(
+			trace.StringAttribute("http.method", r.Method),
+			trace.StringAttribute("http.route", route),
+		)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.AddAttributes(trace.Int64Attribute("http.status_code", int64(rec.status)))
+	})
+}
+
+// statusRecorder captures the status code a handler wrote so it can be
+// attached to the request's span after the handler returns.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// remoteSpanContext parses the X-Cloud-Trace-Context header
+// ("TRACE_ID/SPAN_ID;o=OPTIONS") into an OpenCensus SpanContext.
+func remoteSpanContext(r *http.Request) (trace.SpanContext, bool) {
+	h := r.Header.Get("X-Cloud-Trace-Context")
+	i := strings.IndexByte(h, '/')
+	if i < 0 {
+		return trace.SpanContext{}, false
+	}
+	traceIDHex, rest := h[:i], h[i+1:]
+	spanIDStr, optsStr := rest, ""
+	if j := strings.IndexByte(rest, ';'); j >= 0 {
+		spanIDStr, optsStr = rest[:j], rest[j+1:]
+	}
+
+	traceIDBytes, err := hex.DecodeString(traceIDHex)
+	if err != nil || len(traceIDBytes) != 16 {
+		return trace.SpanContext{}, false
+	}
+	spanIDUint, err := strconv.ParseUint(spanIDStr, 10, 64)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+
+	var sc trace.SpanContext
+	copy(sc.TraceID[:], traceIDBytes)
+	binary.BigEndian.PutUint64(sc.SpanID[:], spanIDUint)
+	if traceOptionsSampled(optsStr) {
+		sc.TraceOptions = trace.TraceOptions(1)
+	}
+	return sc, true
+}
+
+// traceOptionsSampled reports whether the "o=OPTIONS" segment of an
+// X-Cloud-Trace-Context header has its low (sampled) bit set. A missing or
+// malformed segment is treated as not sampled, since ProbabilitySampler
+// always honors an upstream "sampled" decision and would otherwise trace
+// every request carrying the header regardless of TRACE_SAMPLE_RATIO.
+func traceOptionsSampled(optsStr string) bool {
+	if !strings.HasPrefix(optsStr, "o=") {
+		return false
+	}
+	opts, err := strconv.ParseUint(optsStr[len("o="):], 10, 32)
+	if err != nil {
+		return false
+	}
+	return opts&1 == 1
+}
+
+// tracingDialOption wires tracingUnaryClientInterceptor into a Stackdriver
+// client's gRPC connection; pass it to each New*Client call.
+var tracingDialOption = option.WithGRPCDialOption(grpc.WithUnaryInterceptor(tracingUnaryClientInterceptor))
+
+// tracingUnaryClientInterceptor starts a child span around each outbound
+// gRPC call the Stackdriver clients make, so a trace started in
+// tracingMiddleware shows the full HTTP -> gRPC path.
+func tracingUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := trace.StartSpan(ctx, method, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(trace.StatusCodeUnknown), Message: err.Error()})
+	}
+	return err
+}